@@ -51,16 +51,27 @@ func (c *versionsCmd) Describe() string {
 
 func (c *versionsCmd) Usage() {
 	fmt.Fprintf(os.Stderr, "Usage: camtool [globalopts] versions <permanode>\n")
+	fmt.Fprintf(os.Stderr, "       camtool [globalopts] versions diff <permanode> <t1> <t2> [--name-only] [--stat] [--format=json|porcelain]\n")
+	fmt.Fprintf(os.Stderr, "       camtool [globalopts] versions restore <permanode> <at> [--path=sub/dir] [--dry-run]\n")
 }
 
 func (c *versionsCmd) Examples() []string {
 	return []string{
-		`sha1-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx # a permanode` ,
+		`sha1-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx # a permanode`,
 		`- # piped from stdin`,
+		`diff sha1-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx 2014-01-01T00:00:00Z 2014-02-01T00:00:00Z`,
+		`diff sha1-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx 2014-01-01T00:00:00Z 2014-02-01T00:00:00Z --name-only`,
+		`restore sha1-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx 2014-01-01T00:00:00Z --dry-run`,
 	}
 }
 
 func (c *versionsCmd) RunCommand(args []string) error {
+	if len(args) > 0 && args[0] == "diff" {
+		return (&diffCmd{server: c.server}).RunCommand(args[1:])
+	}
+	if len(args) > 0 && args[0] == "restore" {
+		return (&restoreCmd{server: c.server}).RunCommand(args[1:])
+	}
 	if len(args) != 1 {
 		return cmdmain.UsageError("requires permanode")
 	}
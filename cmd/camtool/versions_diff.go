@@ -0,0 +1,303 @@
+/*
+Copyright 2014 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/cmdmain"
+	"camlistore.org/pkg/search"
+)
+
+// parseInstant parses an "@" instant as accepted by the fs package's
+// versioned tree: RFC3339, RFC3339Nano, or Unix seconds.
+func parseInstant(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, errors.New("invalid instant " + strconv.Quote(s))
+}
+
+// diffCmd implements the "camtool versions diff <permanode> <t1> <t2>"
+// sub-command. It's a peer of versionsCmd rather than its own
+// cmdmain.RegisterCommand entry; versionsCmd.RunCommand dispatches to
+// it when invoked as "versions diff ...".
+type diffCmd struct {
+	server string
+}
+
+func (c *diffCmd) RunCommand(args []string) error {
+	var flagArgs, pos []string
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			flagArgs = append(flagArgs, a)
+		} else {
+			pos = append(pos, a)
+		}
+	}
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	nameOnly := fs.Bool("name-only", false, "print only the changed paths, one per line")
+	stat := fs.Bool("stat", false, "print one line per changed path: kind, path and old/new size")
+	format := fs.String("format", "json", "output format when neither --name-only nor --stat is given: json or porcelain")
+	if err := fs.Parse(flagArgs); err != nil {
+		return err
+	}
+	if len(pos) != 3 {
+		return cmdmain.UsageError("requires permanode, t1 and t2")
+	}
+
+	br, ok := blob.Parse(pos[0])
+	if !ok {
+		return cmdmain.UsageError(fmt.Sprintf("invalid blobref %q", pos[0]))
+	}
+	t1, err := parseInstant(pos[1])
+	if err != nil {
+		return cmdmain.UsageError(fmt.Sprintf("invalid t1 %q: %v", pos[1], err))
+	}
+	t2, err := parseInstant(pos[2])
+	if err != nil {
+		return cmdmain.UsageError(fmt.Sprintf("invalid t2 %q: %v", pos[2], err))
+	}
+
+	cl := newClient(c.server)
+	tree1, err := describeTree(cl, br, t1)
+	if err != nil {
+		return fmt.Errorf("describing tree at %v: %v", pos[1], err)
+	}
+	tree2, err := describeTree(cl, br, t2)
+	if err != nil {
+		return fmt.Errorf("describing tree at %v: %v", pos[2], err)
+	}
+
+	changes := diffTrees("", tree1, tree2)
+
+	switch {
+	case *nameOnly:
+		for _, ch := range changes {
+			fmt.Fprintln(os.Stdout, ch.Path)
+		}
+		return nil
+	case *stat:
+		for _, ch := range changes {
+			fmt.Fprintf(os.Stdout, "%-10s %s (%d -> %d bytes)\n", ch.Kind, ch.Path, ch.OldSize, ch.NewSize)
+		}
+		return nil
+	}
+
+	switch *format {
+	case "porcelain":
+		for _, ch := range changes {
+			fmt.Fprintf(os.Stdout, "%s\t%s\n", porcelainKind(ch.Kind), ch.Path)
+		}
+		return nil
+	case "json":
+		resj, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return err
+		}
+		resj = append(resj, '\n')
+		_, err = os.Stdout.Write(resj)
+		return err
+	default:
+		return cmdmain.UsageError(fmt.Sprintf("invalid --format %q", *format))
+	}
+}
+
+// porcelainKind maps a change's Kind to a single letter, git-status
+// style, for --format=porcelain.
+func porcelainKind(kind string) string {
+	switch kind {
+	case "added":
+		return "A"
+	case "removed":
+		return "D"
+	case "modified":
+		return "M"
+	case "type-changed":
+		return "T"
+	default:
+		return "?"
+	}
+}
+
+// treeEntry is a node of a permanode tree as described at some instant,
+// flattened enough to diff without re-hitting the server.
+type treeEntry struct {
+	isDir     bool
+	permanode blob.Ref // the entry's own permanode (root pn, or the camliPath: child)
+	content   blob.Ref // camliContent, for files
+	size      int64    // for files
+	children  map[string]*treeEntry
+}
+
+// describeTree recursively describes the permanode tree rooted at pn as
+// it looked at instant at, mirroring the camliPath: walk that roDirV
+// does against the FUSE server.
+func describeTree(cl *client.Client, pn blob.Ref, at time.Time) (*treeEntry, error) {
+	res, err := cl.Describe(&search.DescribeRequest{
+		BlobRef: pn,
+		Depth:   3,
+		At:      at,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return describeTreeFromRes(cl, res, pn, at)
+}
+
+func describeTreeFromRes(cl *client.Client, res *search.DescribeResponse, pn blob.Ref, at time.Time) (*treeEntry, error) {
+	db := res.Meta[pn.String()]
+	if db == nil || db.Permanode == nil {
+		return nil, fmt.Errorf("permanode %v not described", pn)
+	}
+	ent := &treeEntry{isDir: true, permanode: pn, children: map[string]*treeEntry{}}
+	for k, v := range db.Permanode.Attr {
+		const p = "camliPath:"
+		if !strings.HasPrefix(k, p) || len(v) < 1 {
+			continue
+		}
+		name := k[len(p):]
+		childRef := v[0]
+		child := res.Meta[childRef]
+		if child == nil || child.Permanode == nil {
+			continue
+		}
+		childBr := blob.ParseOrZero(childRef)
+		if isDirAttr(child.Permanode) {
+			sub, err := describeTree(cl, childBr, at)
+			if err != nil {
+				return nil, err
+			}
+			ent.children[name] = sub
+			continue
+		}
+		contentRef := child.Permanode.Attr.Get("camliContent")
+		if contentRef == "" {
+			continue
+		}
+		content := res.Meta[contentRef]
+		if content == nil {
+			continue
+		}
+		ent.children[name] = &treeEntry{
+			permanode: childBr,
+			content:   content.BlobRef,
+			size:      content.File.Size,
+		}
+	}
+	return ent, nil
+}
+
+func isDirAttr(db *search.DescribedPermanode) bool {
+	return db.Attr.Get("camliNodeType") == "directory"
+}
+
+// change describes one path's difference between two instants.
+type change struct {
+	Path          string `json:"path"`
+	Kind          string `json:"kind"` // added, removed, modified, type-changed
+	OldContentRef string `json:"oldContentRef,omitempty"`
+	NewContentRef string `json:"newContentRef,omitempty"`
+	OldSize       int64  `json:"oldSize,omitempty"`
+	NewSize       int64  `json:"newSize,omitempty"`
+}
+
+// diffTrees walks old and new in lockstep, using a merge-style
+// two-pointer pass over their sorted child names so adds/removes cost
+// O(n) instead of a map-in-map lookup per name.
+func diffTrees(prefix string, old, newEnt *treeEntry) []change {
+	var changes []change
+	if old == nil && newEnt == nil {
+		return changes
+	}
+	if old == nil {
+		return []change{{Path: prefix, Kind: "added", NewContentRef: refString(newEnt.content), NewSize: newEnt.size}}
+	}
+	if newEnt == nil {
+		return []change{{Path: prefix, Kind: "removed", OldContentRef: refString(old.content), OldSize: old.size}}
+	}
+	if old.isDir != newEnt.isDir {
+		return []change{{Path: prefix, Kind: "type-changed",
+			OldContentRef: refString(old.content), NewContentRef: refString(newEnt.content),
+			OldSize: old.size, NewSize: newEnt.size}}
+	}
+	if !old.isDir {
+		if old.content != newEnt.content {
+			changes = append(changes, change{
+				Path:          prefix,
+				Kind:          "modified",
+				OldContentRef: refString(old.content),
+				NewContentRef: refString(newEnt.content),
+				OldSize:       old.size,
+				NewSize:       newEnt.size,
+			})
+		}
+		return changes
+	}
+
+	oldNames := sortedNames(old.children)
+	newNames := sortedNames(newEnt.children)
+	i, j := 0, 0
+	for i < len(oldNames) || j < len(newNames) {
+		switch {
+		case j >= len(newNames) || (i < len(oldNames) && oldNames[i] < newNames[j]):
+			changes = append(changes, diffTrees(path.Join(prefix, oldNames[i]), old.children[oldNames[i]], nil)...)
+			i++
+		case i >= len(oldNames) || newNames[j] < oldNames[i]:
+			changes = append(changes, diffTrees(path.Join(prefix, newNames[j]), nil, newEnt.children[newNames[j]])...)
+			j++
+		default:
+			changes = append(changes, diffTrees(path.Join(prefix, oldNames[i]), old.children[oldNames[i]], newEnt.children[newNames[j]])...)
+			i++
+			j++
+		}
+	}
+	return changes
+}
+
+func sortedNames(m map[string]*treeEntry) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func refString(br blob.Ref) string {
+	if !br.Valid() {
+		return ""
+	}
+	return br.String()
+}
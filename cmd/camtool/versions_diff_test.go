@@ -0,0 +1,105 @@
+/*
+Copyright 2014 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"camlistore.org/pkg/blob"
+)
+
+func mustParse(t *testing.T, s string) blob.Ref {
+	br, ok := blob.Parse(s)
+	if !ok {
+		t.Fatalf("invalid test blobref %q", s)
+	}
+	return br
+}
+
+func TestSortedNames(t *testing.T) {
+	m := map[string]*treeEntry{"b": nil, "a": nil, "c": nil}
+	got := sortedNames(m)
+	want := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("sortedNames = %v; want %v", got, want)
+	}
+}
+
+func TestDiffTreesFileChanges(t *testing.T) {
+	c1 := mustParse(t, "sha1-0000000000000000000000000000000000000001")
+	c2 := mustParse(t, "sha1-0000000000000000000000000000000000000002")
+
+	old := &treeEntry{isDir: true, children: map[string]*treeEntry{
+		"unchanged.txt": {content: c1, size: 10},
+		"removed.txt":   {content: c1, size: 5},
+		"modified.txt":  {content: c1, size: 3},
+	}}
+	newEnt := &treeEntry{isDir: true, children: map[string]*treeEntry{
+		"unchanged.txt": {content: c1, size: 10},
+		"modified.txt":  {content: c2, size: 7},
+		"added.txt":     {content: c2, size: 1},
+	}}
+
+	changes := diffTrees("", old, newEnt)
+	byPath := map[string]change{}
+	for _, ch := range changes {
+		byPath[ch.Path] = ch
+	}
+	if len(changes) != 3 {
+		t.Fatalf("got %d changes, want 3: %+v", len(changes), changes)
+	}
+	if ch, ok := byPath["removed.txt"]; !ok || ch.Kind != "removed" {
+		t.Errorf("removed.txt: got %+v", ch)
+	}
+	if ch, ok := byPath["added.txt"]; !ok || ch.Kind != "added" {
+		t.Errorf("added.txt: got %+v", ch)
+	}
+	if ch, ok := byPath["modified.txt"]; !ok || ch.Kind != "modified" || ch.NewSize != 7 {
+		t.Errorf("modified.txt: got %+v", ch)
+	}
+	if _, ok := byPath["unchanged.txt"]; ok {
+		t.Error("unchanged.txt unexpectedly reported as a change")
+	}
+}
+
+func TestDiffTreesTypeChanged(t *testing.T) {
+	c1 := mustParse(t, "sha1-0000000000000000000000000000000000000001")
+	old := &treeEntry{isDir: true, children: map[string]*treeEntry{
+		"x": {isDir: true, children: map[string]*treeEntry{}},
+	}}
+	newEnt := &treeEntry{isDir: true, children: map[string]*treeEntry{
+		"x": {content: c1, size: 4},
+	}}
+	changes := diffTrees("", old, newEnt)
+	if len(changes) != 1 || changes[0].Kind != "type-changed" || changes[0].Path != "x" {
+		t.Fatalf("got %+v; want a single type-changed entry for %q", changes, "x")
+	}
+}
+
+func TestDiffTreesNoChanges(t *testing.T) {
+	c1 := mustParse(t, "sha1-0000000000000000000000000000000000000001")
+	old := &treeEntry{isDir: true, children: map[string]*treeEntry{
+		"a": {content: c1, size: 1},
+	}}
+	newEnt := &treeEntry{isDir: true, children: map[string]*treeEntry{
+		"a": {content: c1, size: 1},
+	}}
+	if changes := diffTrees("", old, newEnt); len(changes) != 0 {
+		t.Fatalf("got %+v; want no changes", changes)
+	}
+}
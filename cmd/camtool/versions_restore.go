@@ -0,0 +1,335 @@
+/*
+Copyright 2014 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/cmdmain"
+	"camlistore.org/pkg/schema"
+)
+
+// restoreCmd implements the
+// "camtool versions restore <permanode> <at> [--path=sub/dir] [--dry-run]"
+// sub-command. Like diffCmd, it's a peer of versionsCmd rather than its
+// own cmdmain.RegisterCommand entry.
+type restoreCmd struct {
+	server string
+}
+
+func (c *restoreCmd) RunCommand(args []string) error {
+	var flagArgs, pos []string
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			flagArgs = append(flagArgs, a)
+		} else {
+			pos = append(pos, a)
+		}
+	}
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	subPath := fs.String("path", "", "restrict the restore to this sub-directory of the permanode")
+	dryRun := fs.Bool("dry-run", false, "print the change set that would be written, without writing any claims")
+	if err := fs.Parse(flagArgs); err != nil {
+		return err
+	}
+	if len(pos) != 2 {
+		return cmdmain.UsageError("requires permanode and at")
+	}
+
+	br, ok := blob.Parse(pos[0])
+	if !ok {
+		return cmdmain.UsageError(fmt.Sprintf("invalid blobref %q", pos[0]))
+	}
+	at, err := parseInstant(pos[1])
+	if err != nil {
+		return cmdmain.UsageError(fmt.Sprintf("invalid at %q: %v", pos[1], err))
+	}
+
+	cl := newClient(c.server)
+	now, err := describeTree(cl, br, time.Time{})
+	if err != nil {
+		return fmt.Errorf("describing current tree: %v", err)
+	}
+	target, err := describeTree(cl, br, at)
+	if err != nil {
+		return fmt.Errorf("describing tree at %v: %v", pos[1], err)
+	}
+
+	nowRoot, nowPn := now, br
+	targetRoot := target
+	if *subPath != "" {
+		nowRoot, nowPn, err = descendTree(now, *subPath)
+		if err != nil {
+			return fmt.Errorf("--path %q not found in current tree: %v", *subPath, err)
+		}
+		targetRoot, _, err = descendTree(target, *subPath)
+		if err != nil {
+			return fmt.Errorf("--path %q not found at %v: %v", *subPath, pos[1], err)
+		}
+	}
+
+	changes, claims, err := restoreDir(cl, *subPath, nowPn, nowRoot, targetRoot, *dryRun)
+	if err != nil {
+		return err
+	}
+	// Walking the tree and diffing it against the target only reads
+	// and allocates orphan permanodes (addSubtree's UploadNewPermanode
+	// calls, unclaimed until one of these claims points at them); none
+	// of it is visible in the live tree yet. Apply the whole staged
+	// batch now, as close to atomically as this API allows: from the
+	// user's POV the restore either hasn't happened at all, or (save
+	// for a failure partway through this loop) has happened in full.
+	for _, pc := range claims {
+		if err := pc.apply(); err != nil {
+			return fmt.Errorf("applying claim (%s): %v", pc.desc, err)
+		}
+	}
+
+	resj, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	resj = append(resj, '\n')
+	_, err = os.Stdout.Write(resj)
+	return err
+}
+
+// descendTree walks down ent following subPath's components and returns
+// the entry found there along with its own permanode.
+func descendTree(ent *treeEntry, subPath string) (*treeEntry, blob.Ref, error) {
+	cur := ent
+	for _, part := range strings.Split(path.Clean(subPath), "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if cur == nil || !cur.isDir {
+			return nil, blob.Ref{}, fmt.Errorf("%q is not a directory", part)
+		}
+		child, ok := cur.children[part]
+		if !ok {
+			return nil, blob.Ref{}, fmt.Errorf("no such entry %q", part)
+		}
+		cur = child
+	}
+	return cur, cur.permanode, nil
+}
+
+// pendingClaim is a claim built (a pure, local call — no network
+// traffic) while walking the tree, but not yet signed/uploaded.
+// restoreDir/addSubtree only stage these; RunCommand applies the
+// entire batch together once the walk succeeds, so a failure while
+// still computing the change set never leaves the live tree
+// half-restored.
+type pendingClaim struct {
+	desc  string // for the error message if applying this claim fails
+	apply func() error
+}
+
+// restoreDir reconciles nowPermanode's camliPath: entries (described by
+// now, which may be nil if this directory doesn't exist yet) against
+// target, the tree as it looked at the restore instant, walking both in
+// lockstep the same way diffTrees does. Unlike diffTrees it also stages
+// the claims needed to make nowPermanode match target, unless dryRun.
+func restoreDir(cl *client.Client, prefix string, nowPermanode blob.Ref, now, target *treeEntry, dryRun bool) ([]change, []pendingClaim, error) {
+	var changes []change
+	var claims []pendingClaim
+	var nowChildren map[string]*treeEntry
+	if now != nil {
+		nowChildren = now.children
+	}
+	var targetChildren map[string]*treeEntry
+	if target != nil {
+		targetChildren = target.children
+	}
+
+	oldNames := sortedNames(nowChildren)
+	newNames := sortedNames(targetChildren)
+	i, j := 0, 0
+	for i < len(oldNames) || j < len(newNames) {
+		switch {
+		case j >= len(newNames) || (i < len(oldNames) && oldNames[i] < newNames[j]):
+			name := oldNames[i]
+			old := nowChildren[name]
+			changes = append(changes, change{
+				Path:          path.Join(prefix, name),
+				Kind:          "removed",
+				OldContentRef: refString(old.content),
+				OldSize:       old.size,
+			})
+			if !dryRun {
+				claims = append(claims, delPathClaim(cl, nowPermanode, name))
+			}
+			i++
+		case i >= len(oldNames) || newNames[j] < oldNames[i]:
+			name := newNames[j]
+			cs, pc, err := addSubtree(cl, path.Join(prefix, name), nowPermanode, name, targetChildren[name], dryRun)
+			if err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, cs...)
+			claims = append(claims, pc...)
+			j++
+		default:
+			name := oldNames[i]
+			nowChild := nowChildren[name]
+			targetChild := targetChildren[name]
+			p := path.Join(prefix, name)
+			switch {
+			case nowChild.isDir != targetChild.isDir:
+				changes = append(changes, change{
+					Path:          p,
+					Kind:          "type-changed",
+					OldContentRef: refString(nowChild.content),
+					NewContentRef: refString(targetChild.content),
+					OldSize:       nowChild.size,
+					NewSize:       targetChild.size,
+				})
+				if !dryRun {
+					claims = append(claims, delPathClaim(cl, nowPermanode, name))
+					cs, pc, err := addSubtree(cl, p, nowPermanode, name, targetChild, false)
+					if err != nil {
+						return nil, nil, err
+					}
+					changes = append(changes, cs...)
+					claims = append(claims, pc...)
+				}
+			case nowChild.isDir:
+				cs, pc, err := restoreDir(cl, p, nowChild.permanode, nowChild, targetChild, dryRun)
+				if err != nil {
+					return nil, nil, err
+				}
+				changes = append(changes, cs...)
+				claims = append(claims, pc...)
+			case nowChild.content != targetChild.content:
+				changes = append(changes, change{
+					Path:          p,
+					Kind:          "modified",
+					OldContentRef: refString(nowChild.content),
+					NewContentRef: refString(targetChild.content),
+					OldSize:       nowChild.size,
+					NewSize:       targetChild.size,
+				})
+				if !dryRun {
+					claims = append(claims, setContentClaim(cl, nowChild.permanode, targetChild.content))
+				}
+			}
+			i++
+			j++
+		}
+	}
+	return changes, claims, nil
+}
+
+// addSubtree materializes te (absent from the current tree) under
+// parentPermanode as name, recursively for directories. Files are
+// pointed at their historical camliContent blobref directly; nothing is
+// re-uploaded, since that blob is already on the server. Permanodes
+// themselves (unlike the claims pointing at them) must be allocated
+// during the walk: their blobref isn't known until UploadNewPermanode
+// returns. That's harmless to atomicity, since an allocated but
+// unclaimed permanode is invisible to the live tree until one of the
+// staged claims below points at it.
+func addSubtree(cl *client.Client, p string, parentPermanode blob.Ref, name string, te *treeEntry, dryRun bool) ([]change, []pendingClaim, error) {
+	if te.isDir {
+		changes := []change{{Path: p, Kind: "added"}}
+		var claims []pendingClaim
+		var childPermanode blob.Ref
+		if !dryRun {
+			pr, err := cl.UploadNewPermanode()
+			if err != nil {
+				return nil, nil, err
+			}
+			childPermanode = pr.BlobRef
+			claims = append(claims, pathClaim(cl, parentPermanode, name, childPermanode))
+		}
+		for _, childName := range sortedNames(te.children) {
+			cs, pc, err := addSubtree(cl, path.Join(p, childName), childPermanode, childName, te.children[childName], dryRun)
+			if err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, cs...)
+			claims = append(claims, pc...)
+		}
+		return changes, claims, nil
+	}
+
+	changes := []change{{Path: p, Kind: "added", NewContentRef: refString(te.content), NewSize: te.size}}
+	if dryRun {
+		return changes, nil, nil
+	}
+	pr, err := cl.UploadNewPermanode()
+	if err != nil {
+		return nil, nil, err
+	}
+	claims := []pendingClaim{
+		setContentClaim(cl, pr.BlobRef, te.content),
+		pathClaim(cl, parentPermanode, name, pr.BlobRef),
+	}
+	return changes, claims, nil
+}
+
+// pathClaim stages a camliPath: entry pointing name at child under dir.
+func pathClaim(cl *client.Client, dir blob.Ref, name string, child blob.Ref) pendingClaim {
+	claim := schema.NewSetAttributeClaim(dir, "camliPath:"+name, child.String())
+	return pendingClaim{
+		desc: fmt.Sprintf("set camliPath:%s on %v", name, dir),
+		apply: func() error {
+			_, err := cl.UploadAndSignBlob(claim)
+			return err
+		},
+	}
+}
+
+// delPathClaim stages removal of name from dir's camliPath: entries.
+// Unlike cowDirV's camliDeleted: whiteout (which masks a read-only
+// lower layer it has no write access to), restore operates directly on
+// the live permanode tree, so it can and should delete the claim
+// outright: a plain roDirV only ever looks at camliPath: attributes, so
+// anything short of an actual deletion would leave the "removed" path
+// visible.
+func delPathClaim(cl *client.Client, dir blob.Ref, name string) pendingClaim {
+	claim := schema.NewDelAttributeClaim(dir, "camliPath:"+name, "")
+	return pendingClaim{
+		desc: fmt.Sprintf("delete camliPath:%s on %v", name, dir),
+		apply: func() error {
+			_, err := cl.UploadAndSignBlob(claim)
+			return err
+		},
+	}
+}
+
+// setContentClaim stages pointing filePermanode's camliContent at
+// content, the blobref of a file schema blob that's already on the
+// server.
+func setContentClaim(cl *client.Client, filePermanode blob.Ref, content blob.Ref) pendingClaim {
+	claim := schema.NewSetAttributeClaim(filePermanode, "camliContent", content.String())
+	return pendingClaim{
+		desc: fmt.Sprintf("set camliContent on %v", filePermanode),
+		apply: func() error {
+			_, err := cl.UploadAndSignBlob(claim)
+			return err
+		},
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2014 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package contenthash implements a per-mount cache of content-hash
+// digests for the fs package's versioned FUSE tree, keyed by cleaned
+// absolute path within a versioned root. It's backed by an immutable
+// radix tree so a Get never blocks a concurrent Put, and a snapshot of
+// the tree held by an in-flight populate never observes a later write.
+package contenthash
+
+import (
+	"crypto/sha256"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Digest is a SHA-256 content-hash.
+type Digest [sha256.Size]byte
+
+// DirHeader is one child entry folded into a directory's structural
+// digest by HashDir.
+type DirHeader struct {
+	Name        string
+	Mode        uint32
+	ChildDigest Digest
+}
+
+// HashDir computes a directory's structural digest from its
+// (name, mode, childDigest) headers. The headers are sorted by name
+// first, so the result doesn't depend on enumeration order.
+func HashDir(headers []DirHeader) Digest {
+	sorted := append([]DirHeader(nil), headers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	h := sha256.New()
+	for _, hd := range sorted {
+		h.Write([]byte(hd.Name))
+		h.Write([]byte{0})
+		h.Write([]byte{byte(hd.Mode >> 24), byte(hd.Mode >> 16), byte(hd.Mode >> 8), byte(hd.Mode)})
+		h.Write(hd.ChildDigest[:])
+	}
+	var d Digest
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+// HashBlobRef returns a file's digest: the hash of its camliContent
+// blobref string.
+func HashBlobRef(ref string) Digest {
+	return sha256.Sum256([]byte(ref))
+}
+
+// CleanPath returns the canonical cache key for p.
+func CleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return path.Clean(p)
+}
+
+// node is one node of the immutable trie backing Cache. A nil *node is
+// the empty tree; inserting along a key copies only the nodes on that
+// key's path, leaving every sibling subtree shared with the prior
+// tree.
+type node struct {
+	value    Digest
+	hasValue bool
+	children map[byte]*node
+}
+
+func (n *node) get(key string) (Digest, bool) {
+	for i := 0; i < len(key); i++ {
+		if n == nil {
+			return Digest{}, false
+		}
+		n = n.children[key[i]]
+	}
+	if n == nil || !n.hasValue {
+		return Digest{}, false
+	}
+	return n.value, true
+}
+
+func insert(n *node, key string, v Digest) *node {
+	var cp node
+	if n != nil {
+		cp = *n
+	}
+	cp.children = nil // rebuilt below, copy-on-write
+
+	if key == "" {
+		cp.value = v
+		cp.hasValue = true
+		if n != nil {
+			cp.children = n.children
+		}
+		return &cp
+	}
+
+	var orig map[byte]*node
+	if n != nil {
+		orig = n.children
+	}
+	children := make(map[byte]*node, len(orig)+1)
+	for b, c := range orig {
+		children[b] = c
+	}
+	children[key[0]] = insert(orig[key[0]], key[1:], v)
+	cp.children = children
+	return &cp
+}
+
+// remove deletes the subtree rooted at key from n, returning the
+// replacement node (nil if nothing is left). Like insert, it only
+// copies the nodes on key's path; untouched siblings are shared with
+// the prior tree.
+func remove(n *node, key string) *node {
+	if n == nil {
+		return nil
+	}
+	if key == "" {
+		// key names this node itself: drop it and everything below it.
+		return nil
+	}
+	existing, had := n.children[key[0]]
+	if !had {
+		// Nothing cached under this byte: n is unaffected.
+		return n
+	}
+	child := remove(existing, key[1:])
+	cp := *n
+	children := make(map[byte]*node, len(n.children))
+	for b, c := range n.children {
+		children[b] = c
+	}
+	if child == nil {
+		delete(children, key[0])
+	} else {
+		children[key[0]] = child
+	}
+	if len(children) == 0 {
+		cp.children = nil
+	} else {
+		cp.children = children
+	}
+	if !cp.hasValue && len(cp.children) == 0 {
+		return nil
+	}
+	return &cp
+}
+
+// Cache is a per-mount cache of content-hash digests, keyed by cleaned
+// absolute path. It's safe for concurrent use.
+type Cache struct {
+	mu   sync.Mutex // guards swapping root and sizes; the trie itself is immutable
+	root *node
+
+	// sizes caches the resolved size of a camliContent blobref, so a
+	// second dated version (or a second file) pointing at a
+	// previously-seen blobref doesn't need its own Describe round
+	// trip: unlike a directory, a content blob never changes once
+	// described.
+	sizes map[string]int64
+}
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	return &Cache{}
+}
+
+// Get returns the digest cached for path, if any.
+func (c *Cache) Get(path string) (Digest, bool) {
+	c.mu.Lock()
+	root := c.root
+	c.mu.Unlock()
+	return root.get(CleanPath(path))
+}
+
+// Put records digest as the cached value for path.
+func (c *Cache) Put(path string, digest Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.root = insert(c.root, CleanPath(path), digest)
+}
+
+// Invalidate drops the cached digest for path and everything nested
+// under it, e.g. after a mutation makes a subtree's previously-cached
+// digests stale.
+func (c *Cache) Invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.root = remove(c.root, CleanPath(path))
+}
+
+// GetSize returns the previously-cached size of the file content
+// blobref, if any.
+func (c *Cache) GetSize(contentRef string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size, ok := c.sizes[contentRef]
+	return size, ok
+}
+
+// PutSize records size as the size of the file content blobref.
+func (c *Cache) PutSize(contentRef string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizes == nil {
+		c.sizes = make(map[string]int64)
+	}
+	c.sizes[contentRef] = size
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2014 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCacheGetPut(t *testing.T) {
+	c := NewCache()
+	if _, ok := c.Get("/a/b"); ok {
+		t.Fatal("Get on empty cache returned ok")
+	}
+	d := HashBlobRef("sha1-abc")
+	c.Put("/a/b", d)
+	if got, ok := c.Get("/a/b"); !ok || got != d {
+		t.Fatalf("Get(/a/b) = %x, %v; want %x, true", got, ok, d)
+	}
+	if got, ok := c.Get("a/b"); !ok || got != d {
+		t.Fatalf("Get(a/b) (uncleaned) = %x, %v; want %x, true", got, ok, d)
+	}
+	if _, ok := c.Get("/a/c"); ok {
+		t.Fatal("Get(/a/c) unexpectedly found a value")
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := NewCache()
+	c.Put("/root/sub/file", HashBlobRef("sha1-file"))
+	c.Put("/root/sub/", HashBlobRef("sha1-sub"))
+	c.Put("/root/", HashBlobRef("sha1-root"))
+	c.Put("/other/", HashBlobRef("sha1-other"))
+
+	c.Invalidate("/root")
+
+	for _, p := range []string{"/root/sub/file", "/root/sub/", "/root/"} {
+		if _, ok := c.Get(p); ok {
+			t.Errorf("Get(%q) still cached after Invalidate(/root)", p)
+		}
+	}
+	if _, ok := c.Get("/other/"); !ok {
+		t.Error("Invalidate(/root) dropped an unrelated sibling")
+	}
+}
+
+func TestCacheInvalidateUncachedSiblingIsNoop(t *testing.T) {
+	c := NewCache()
+	c.Put("/alpha/file", HashBlobRef("sha1-alpha"))
+
+	// /beta was never Put: this must not disturb /alpha, even though
+	// /alpha is currently the only child at the byte where "alpha" and
+	// "beta" diverge.
+	c.Invalidate("/beta")
+
+	if _, ok := c.Get("/alpha/file"); !ok {
+		t.Fatal("Invalidate of an unrelated, never-cached path dropped /alpha/file")
+	}
+}
+
+func TestCacheSizes(t *testing.T) {
+	c := NewCache()
+	if _, ok := c.GetSize("sha1-abc"); ok {
+		t.Fatal("GetSize on empty cache returned ok")
+	}
+	c.PutSize("sha1-abc", 42)
+	if got, ok := c.GetSize("sha1-abc"); !ok || got != 42 {
+		t.Fatalf("GetSize(sha1-abc) = %v, %v; want 42, true", got, ok)
+	}
+}
+
+func TestHashDirOrderIndependent(t *testing.T) {
+	a := DirHeader{Name: "a", Mode: 0400, ChildDigest: HashBlobRef("sha1-a")}
+	b := DirHeader{Name: "b", Mode: 0400, ChildDigest: HashBlobRef("sha1-b")}
+	c := DirHeader{Name: "c", Mode: uint32(os.ModeDir | 0500), ChildDigest: HashBlobRef("sha1-c")}
+
+	d1 := HashDir([]DirHeader{a, b, c})
+	d2 := HashDir([]DirHeader{c, a, b})
+	d3 := HashDir([]DirHeader{b, c, a})
+	if d1 != d2 || d1 != d3 {
+		t.Fatal("HashDir depends on header order")
+	}
+
+	d4 := HashDir([]DirHeader{a, b})
+	if d4 == d1 {
+		t.Fatal("HashDir(a,b) == HashDir(a,b,c); removing an entry should change the digest")
+	}
+}
@@ -0,0 +1,744 @@
+// +build linux darwin
+
+/*
+Copyright 2014 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file implements a writable copy-on-write overlay on top of a
+// roDirV read-only versioned subtree. It's reachable at
+// /versions/workspace/<name>, one entry per permanode tagged
+// camliWritableRoot:<name> (see workspaceDir, below); a workspace
+// shadows the same-named /versions root, if any.
+
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+
+	"camlistore.org/third_party/bazil.org/fuse"
+	"camlistore.org/third_party/bazil.org/fuse/fs"
+)
+
+// cowDirV is a writable directory overlaid on top of a roDirV subtree.
+// It is backed by its own permanode (n.permanode), which plays exactly
+// the role a roDirV's permanode plays: camliPath:<name> attributes name
+// the upper-layer entries, new directories get a permanode of their
+// own. A camliDeleted:<name> attribute on n.permanode whites out a
+// same-named entry in the lower layer. Reads of a name with no upper
+// entry and no whiteout fall through to n.lower.
+type cowDirV struct {
+	fs        *CamliFileSystem
+	permanode blob.Ref // this dir's own, writable, permanode
+	lower     *roDirV  // read-only shadow, or nil for a dir created upstairs
+	parent    *cowDirV // nil at the overlay root
+	name      string
+
+	mu       sync.Mutex
+	children map[string]roFileOrDir // upper-layer entries only
+	deleted  map[string]bool        // whiteouts
+	xattrs   map[string][]byte
+}
+
+// newCowDirV returns the writable root of the overlay: workspace is the
+// camliWritableRoot-tagged permanode (see workspaceDir) that the upper
+// layer's claims are written against, and lower is the versioned
+// subtree it shadows, or nil for a workspace with no same-named root.
+func newCowDirV(cfs *CamliFileSystem, workspace blob.Ref, lower *roDirV) *cowDirV {
+	return &cowDirV{
+		fs:        cfs,
+		permanode: workspace,
+		lower:     lower,
+	}
+}
+
+func (n *cowDirV) fullPath() string {
+	if n == nil {
+		return ""
+	}
+	return filepath.Join(n.parent.fullPath(), n.name)
+}
+
+func (n *cowDirV) permanodeString() string {
+	return n.permanode.String()
+}
+
+func (n *cowDirV) Attr() fuse.Attr {
+	return fuse.Attr{
+		Inode: n.permanode.Sum64(),
+		Mode:  os.ModeDir | 0700,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+	}
+}
+
+// populate loads the upper-layer overrides for this directory: the
+// camliPath:<name> entries and camliDeleted:<name> whiteouts recorded
+// directly on n.permanode.
+func (n *cowDirV) populate() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.children != nil {
+		return nil
+	}
+
+	n.children = make(map[string]roFileOrDir)
+	n.deleted = make(map[string]bool)
+
+	if !n.permanode.Valid() {
+		// Not copied-up yet: nothing in the upper layer.
+		return nil
+	}
+
+	res, err := n.fs.client.Describe(&search.DescribeRequest{
+		BlobRef: n.permanode,
+		Depth:   3,
+	})
+	if err != nil {
+		log.Println("cowDirV.populate:", err)
+		return err
+	}
+	db := res.Meta[n.permanode.String()]
+	if db == nil {
+		return errors.New("cowDirV: dir permanode not described")
+	}
+
+	for k, v := range db.Permanode.Attr {
+		if strings.HasPrefix(k, "camliDeleted:") {
+			name := k[len("camliDeleted:"):]
+			if len(v) > 0 && v[0] == "1" {
+				n.deleted[name] = true
+			}
+			continue
+		}
+		const p = "camliPath:"
+		if !strings.HasPrefix(k, p) || len(v) < 1 {
+			continue
+		}
+		name := k[len(p):]
+		childRef := v[0]
+		child := res.Meta[childRef]
+		if child == nil {
+			log.Printf("cowDirV: upper child not described: %v", childRef)
+			continue
+		}
+		childBr := blob.ParseOrZero(childRef)
+		if isDir(child.Permanode) {
+			var lower *roDirV
+			if n.lower != nil {
+				if lc, ok := n.lower.children[name]; ok {
+					if rd, ok := lc.(*roDirV); ok {
+						lower = rd
+					}
+				}
+			}
+			n.children[name] = &cowDirV{
+				fs:        n.fs,
+				permanode: childBr,
+				lower:     lower,
+				parent:    n,
+				name:      name,
+			}
+		} else if contentRef := child.Permanode.Attr.Get("camliContent"); contentRef != "" {
+			content := res.Meta[contentRef]
+			if content == nil {
+				log.Printf("cowDirV: upper content not described: %v", contentRef)
+				continue
+			}
+			n.children[name] = &cowFileVersion{
+				fs:        n.fs,
+				permanode: childBr,
+				parent:    n,
+				name:      name,
+				content:   content.BlobRef,
+				size:      content.File.Size,
+			}
+		}
+	}
+	return nil
+}
+
+func (n *cowDirV) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	if err := n.populate(); err != nil {
+		return nil, fuse.EIO
+	}
+	seen := map[string]bool{}
+	var ents []fuse.Dirent
+
+	n.mu.Lock()
+	for name, child := range n.children {
+		seen[name] = true
+		var ino uint64
+		switch v := child.(type) {
+		case *cowDirV:
+			ino = v.permanode.Sum64()
+		case *cowFileVersion:
+			ino = v.permanode.Sum64()
+		}
+		ents = append(ents, fuse.Dirent{Name: name, Inode: ino})
+	}
+	deleted := n.deleted
+	n.mu.Unlock()
+
+	if n.lower != nil {
+		lowerEnts, err := n.lower.ReadDir(intr)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range lowerEnts {
+			if seen[e.Name] || deleted[e.Name] {
+				continue
+			}
+			ents = append(ents, e)
+		}
+	}
+	return ents, nil
+}
+
+func (n *cowDirV) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	if err := n.populate(); err != nil {
+		return nil, fuse.EIO
+	}
+	n.mu.Lock()
+	child, ok := n.children[name]
+	isDeleted := n.deleted[name]
+	n.mu.Unlock()
+	if ok {
+		return child, nil
+	}
+	if isDeleted {
+		return nil, fuse.ENOENT
+	}
+	if n.lower == nil {
+		return nil, fuse.ENOENT
+	}
+	lnod, err := n.lower.Lookup(name, intr)
+	if err != nil {
+		return nil, err
+	}
+	switch v := lnod.(type) {
+	case *roDirV:
+		return &cowDirV{fs: n.fs, lower: v, parent: n, name: name}, nil
+	default:
+		// A plain file (or symlink) below: copy-up happens lazily,
+		// the first time it's actually opened for writing.
+		return &cowFileVersion{fs: n.fs, lowerNode: lnod, parent: n, name: name}, nil
+	}
+}
+
+// ensurePermanode copies this directory up into the writable layer if
+// it isn't already there, uploading a fresh permanode and wiring it
+// into its parent via a camliPath:<name> claim.
+func (n *cowDirV) ensurePermanode() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ensurePermanodeLocked()
+}
+
+// ensurePermanodeLocked is ensurePermanode's body. Requires n.mu held.
+func (n *cowDirV) ensurePermanodeLocked() error {
+	if err := n.copyUpLocked(); err != nil {
+		return err
+	}
+	if n.parent != nil {
+		if err := n.parent.claimChild(n.name, n.permanode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensurePermanodeForMove copies n up into the writable layer if it
+// isn't already there, like ensurePermanode, but does NOT claim it
+// into n.parent. Rename uses this: n may be a transient node (from a
+// Lookup fallback) whose parent is really the *source* directory, and
+// claiming it there would add a camliPath:<name> entry right next to
+// the whiteout Rename is about to add for that same name — leaving
+// the old name resolving alongside the new one instead of moved. The
+// caller is responsible for claiming the returned permanode wherever
+// it's actually headed.
+func (n *cowDirV) ensurePermanodeForMove() (blob.Ref, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.copyUpLocked(); err != nil {
+		return blob.Ref{}, err
+	}
+	return n.permanode, nil
+}
+
+// copyUpLocked uploads a fresh permanode for n if it doesn't have one
+// yet. Requires n.mu held.
+func (n *cowDirV) copyUpLocked() error {
+	if n.permanode.Valid() {
+		return nil
+	}
+	pr, err := n.fs.client.UploadNewPermanode()
+	if err != nil {
+		return err
+	}
+	n.permanode = pr.BlobRef
+	n.children = make(map[string]roFileOrDir)
+	n.deleted = make(map[string]bool)
+	return nil
+}
+
+// claimChild records name => childRef as an upper-layer entry of n,
+// copying n up into the writable layer first if needed.
+func (n *cowDirV) claimChild(name string, childRef blob.Ref) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.ensurePermanodeLocked(); err != nil {
+		return err
+	}
+	claim := schema.NewSetAttributeClaim(n.permanode, "camliPath:"+name, childRef.String())
+	if _, err := n.fs.client.UploadAndSignBlob(claim); err != nil {
+		return err
+	}
+	delete(n.deleted, name)
+	return nil
+}
+
+// whiteout records name as deleted in the upper layer, copying n up
+// into the writable layer first if needed.
+func (n *cowDirV) whiteout(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.ensurePermanodeLocked(); err != nil {
+		return err
+	}
+	claim := schema.NewSetAttributeClaim(n.permanode, "camliDeleted:"+name, "1")
+	if _, err := n.fs.client.UploadAndSignBlob(claim); err != nil {
+		return err
+	}
+	delete(n.children, name)
+	n.deleted[name] = true
+	return nil
+}
+
+func (n *cowDirV) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
+	if err := n.populate(); err != nil {
+		return nil, fuse.EIO
+	}
+	child := &cowDirV{fs: n.fs, parent: n, name: req.Name}
+	if err := child.ensurePermanode(); err != nil {
+		log.Printf("cowDirV.Mkdir(%q): %v", req.Name, err)
+		return nil, fuse.EIO
+	}
+	n.mu.Lock()
+	n.children[req.Name] = child
+	n.mu.Unlock()
+	return child, nil
+}
+
+func (n *cowDirV) Create(req *fuse.CreateRequest, resp *fuse.CreateResponse, intr fs.Intr) (fs.Node, fs.Handle, fuse.Error) {
+	if err := n.populate(); err != nil {
+		return nil, nil, fuse.EIO
+	}
+	f := &cowFileVersion{fs: n.fs, parent: n, name: req.Name}
+	// Claim the (still-empty) file right away: a file created and
+	// closed without ever being written to (e.g. "touch") must survive
+	// a remount, same as Mkdir already ensures for directories.
+	if err := f.ensurePermanode(); err != nil {
+		log.Printf("cowDirV.Create(%q): %v", req.Name, err)
+		return nil, nil, fuse.EIO
+	}
+	n.mu.Lock()
+	n.children[req.Name] = f
+	delete(n.deleted, req.Name)
+	n.mu.Unlock()
+	return f, f, nil
+}
+
+func (n *cowDirV) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
+	if err := n.populate(); err != nil {
+		return fuse.EIO
+	}
+	if err := n.whiteout(req.Name); err != nil {
+		log.Printf("cowDirV.Remove(%q): %v", req.Name, err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (n *cowDirV) Rename(req *fuse.RenameRequest, newDir fs.Node, intr fs.Intr) fuse.Error {
+	if err := n.populate(); err != nil {
+		return fuse.EIO
+	}
+	dest, ok := newDir.(*cowDirV)
+	if !ok {
+		return fuse.EIO
+	}
+	n.mu.Lock()
+	child, ok := n.children[req.OldName]
+	n.mu.Unlock()
+	if !ok {
+		lnod, err := n.Lookup(req.OldName, intr)
+		if err != nil {
+			return err
+		}
+		child = lnod.(roFileOrDir)
+	}
+
+	// Use ensurePermanodeForMove, not ensurePermanode: child may be a
+	// transient node from the Lookup fallback above, whose parent is
+	// really n (the source dir) under req.OldName. ensurePermanode
+	// would claim it there too, leaving a stray camliPath:<OldName>
+	// claim alongside the whiteout below instead of actually moving
+	// it. dest.claimChild, just below, is the only claim this rename
+	// should produce.
+	var childRef blob.Ref
+	switch v := child.(type) {
+	case *cowDirV:
+		ref, perr := v.ensurePermanodeForMove()
+		if perr != nil {
+			return fuse.EIO
+		}
+		childRef = ref
+	case *cowFileVersion:
+		ref, perr := v.ensurePermanodeForMove()
+		if perr != nil {
+			return fuse.EIO
+		}
+		childRef = ref
+	default:
+		return fuse.EIO
+	}
+
+	if err := dest.claimChild(req.NewName, childRef); err != nil {
+		log.Printf("cowDirV.Rename(%q -> %q): %v", req.OldName, req.NewName, err)
+		return fuse.EIO
+	}
+	if err := n.whiteout(req.OldName); err != nil {
+		log.Printf("cowDirV.Rename: whiteout %q: %v", req.OldName, err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (n *cowDirV) Getxattr(req *fuse.GetxattrRequest, res *fuse.GetxattrResponse, intr fs.Intr) fuse.Error {
+	return n.xattr().get(req, res)
+}
+
+func (n *cowDirV) Listxattr(req *fuse.ListxattrRequest, res *fuse.ListxattrResponse, intr fs.Intr) fuse.Error {
+	return n.xattr().list(req, res)
+}
+
+func (n *cowDirV) xattr() *xattr {
+	return &xattr{"cowDirV", n.fs, n.permanode, &n.mu, &n.xattrs}
+}
+
+// cowFileVersion is a writable file in the upper layer. Until the first
+// write, it may simply shadow a lowerNode (a *roFileVersion or similar
+// read-only leaf from the roDirV it overlays); the first write copies
+// it up by uploading a permanode of its own.
+type cowFileVersion struct {
+	fs        *CamliFileSystem
+	permanode blob.Ref // valid once copied up into the writable layer
+	lowerNode fs.Node  // read-only shadow, until copied up
+	parent    *cowDirV
+	name      string
+
+	mu      sync.Mutex
+	content blob.Ref // camliContent of the upper version, once written
+	size    int64
+	pending bytes.Buffer // buffered writes, flushed on Flush/Release
+	dirty   bool
+	xattrs  map[string][]byte
+}
+
+func (n *cowFileVersion) fullPath() string {
+	if n == nil {
+		return ""
+	}
+	return filepath.Join(n.parent.fullPath(), n.name)
+}
+
+func (n *cowFileVersion) permanodeString() string {
+	return n.permanode.String()
+}
+
+func (n *cowFileVersion) Attr() fuse.Attr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.permanode.Valid() && n.lowerNode != nil {
+		a := n.lowerNode.Attr()
+		a.Mode = (a.Mode &^ os.ModePerm) | 0600
+		return a
+	}
+	size := n.size
+	return fuse.Attr{
+		Inode: n.permanode.Sum64(),
+		Mode:  0600,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Size:  uint64(size),
+	}
+}
+
+// ensurePermanode copies this file up into the writable layer if it
+// isn't already there: it uploads a permanode, points it at the
+// existing content (if any), and wires it into the parent directory.
+func (n *cowFileVersion) ensurePermanode() error {
+	permanode, err := n.copyUp()
+	if err != nil {
+		return err
+	}
+	return n.parent.claimChild(n.name, permanode)
+}
+
+// ensurePermanodeForMove copies n up into the writable layer if it
+// isn't already there, like ensurePermanode, but does NOT claim it
+// into n.parent. See cowDirV.ensurePermanodeForMove for why Rename
+// needs this instead of ensurePermanode.
+func (n *cowFileVersion) ensurePermanodeForMove() (blob.Ref, error) {
+	return n.copyUp()
+}
+
+// copyUp uploads a fresh permanode for n if it doesn't have one yet,
+// pointing it at n's existing content (if any). Unlike cowDirV's
+// copyUpLocked, it's self-locking: cowFileVersion has no analogue of
+// claimChild/whiteout that already holds n.mu before copying up.
+func (n *cowFileVersion) copyUp() (blob.Ref, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.permanode.Valid() {
+		return n.permanode, nil
+	}
+	pr, err := n.fs.client.UploadNewPermanode()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	n.permanode = pr.BlobRef
+	if rfv, ok := n.lowerNode.(*roFileVersion); ok {
+		n.content = rfv.content
+		n.size = rfv.size
+		claim := schema.NewSetAttributeClaim(n.permanode, "camliContent", n.content.String())
+		if _, err := n.fs.client.UploadAndSignBlob(claim); err != nil {
+			return blob.Ref{}, err
+		}
+	}
+	return n.permanode, nil
+}
+
+func (n *cowFileVersion) Open(req *fuse.OpenRequest, res *fuse.OpenResponse, intr fs.Intr) (fs.Handle, fuse.Error) {
+	if isWriteFlags(req.Flags) {
+		if err := n.ensurePermanode(); err != nil {
+			log.Printf("cowFileVersion.Open(%q): %v", n.name, err)
+			return nil, fuse.EIO
+		}
+		// n itself is the handle for writes: it implements Write and
+		// Flush directly, buffering into n.pending.
+		res.Flags &= ^fuse.OpenDirectIO
+		return n, nil
+	}
+
+	n.mu.Lock()
+	content := n.content
+	lower := n.lowerNode
+	n.mu.Unlock()
+
+	if !content.Valid() {
+		if lower == nil {
+			// Created (e.g. by touch) but never written to, and there's
+			// no lower entry to shadow: an empty file, all of whose
+			// content is whatever's in n.pending so far (nothing, unless
+			// a writer raced us). n itself serves the read via Read.
+			res.Flags &= ^fuse.OpenDirectIO
+			return n, nil
+		}
+		// Nothing of our own has ever been written: reads fall
+		// through entirely to the lower, read-only version, same as
+		// Lookup/ReadDir already do for names with no upper entry.
+		opener, ok := lower.(fs.NodeOpener)
+		if !ok {
+			log.Printf("cowFileVersion.Open(%q): lower node %T has no Open", n.name, lower)
+			return nil, fuse.EIO
+		}
+		return opener.Open(req, res, intr)
+	}
+
+	r, err := schema.NewFileReader(n.fs.fetcher, content)
+	if err != nil {
+		log.Printf("cowFileVersion.Open(%q): %v", n.name, err)
+		return nil, fuse.EIO
+	}
+	res.Flags &= ^fuse.OpenDirectIO
+	return &nodeReader{n: &node{fs: n.fs, blobref: content}, fr: r}, nil
+}
+
+// Read serves reads against n.pending, the in-memory buffer of
+// whatever's been Write()n to n so far. It's only ever the handle for
+// a file with no content blob and no lower shadow yet (see Open): such
+// a file's entire content, by construction, is n.pending.
+func (n *cowFileVersion) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fs.Intr) fuse.Error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	buf := n.pending.Bytes()
+	if req.Offset >= int64(len(buf)) {
+		res.Data = nil
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(buf)) {
+		end = int64(len(buf))
+	}
+	res.Data = buf[req.Offset:end]
+	return nil
+}
+
+func (n *cowFileVersion) Write(req *fuse.WriteRequest, res *fuse.WriteResponse, intr fs.Intr) fuse.Error {
+	if err := n.ensurePermanode(); err != nil {
+		return fuse.EIO
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if int64(n.pending.Len()) < req.Offset {
+		n.pending.Write(make([]byte, req.Offset-int64(n.pending.Len())))
+	}
+	buf := n.pending.Bytes()
+	end := req.Offset + int64(len(req.Data))
+	if end > int64(len(buf)) {
+		grown := make([]byte, end)
+		copy(grown, buf)
+		n.pending.Reset()
+		n.pending.Write(grown)
+		buf = n.pending.Bytes()
+	}
+	copy(buf[req.Offset:end], req.Data)
+	n.dirty = true
+	res.Size = len(req.Data)
+	return nil
+}
+
+func (n *cowFileVersion) Flush(req *fuse.FlushRequest, intr fs.Intr) fuse.Error {
+	n.mu.Lock()
+	if !n.dirty {
+		n.mu.Unlock()
+		return nil
+	}
+	data := append([]byte(nil), n.pending.Bytes()...)
+	n.mu.Unlock()
+
+	fileRef, err := schema.WriteFileFromReader(n.fs.client, n.name, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("cowFileVersion.Flush(%q): %v", n.name, err)
+		return fuse.EIO
+	}
+	claim := schema.NewSetAttributeClaim(n.permanode, "camliContent", fileRef.String())
+	if _, err := n.fs.client.UploadAndSignBlob(claim); err != nil {
+		log.Printf("cowFileVersion.Flush(%q): %v", n.name, err)
+		return fuse.EIO
+	}
+
+	n.mu.Lock()
+	n.content = fileRef
+	n.size = int64(len(data))
+	n.dirty = false
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *cowFileVersion) Fsync(r *fuse.FsyncRequest, intr fs.Intr) fuse.Error {
+	return n.Flush(&fuse.FlushRequest{}, intr)
+}
+
+func (n *cowFileVersion) Getxattr(req *fuse.GetxattrRequest, res *fuse.GetxattrResponse, intr fs.Intr) fuse.Error {
+	return n.xattr().get(req, res)
+}
+
+func (n *cowFileVersion) Listxattr(req *fuse.ListxattrRequest, res *fuse.ListxattrResponse, intr fs.Intr) fuse.Error {
+	return n.xattr().list(req, res)
+}
+
+func (n *cowFileVersion) Setxattr(req *fuse.SetxattrRequest, intr fs.Intr) fuse.Error {
+	return fuse.EPERM
+}
+
+func (n *cowFileVersion) Removexattr(req *fuse.RemovexattrRequest, intr fs.Intr) fuse.Error {
+	return fuse.EPERM
+}
+
+func (n *cowFileVersion) xattr() *xattr {
+	return &xattr{"cowFileVersion", n.fs, n.permanode, &n.mu, &n.xattrs}
+}
+
+// workspaceDir is the "workspace" directory under /versions: one entry
+// per --writable-versions workspace (a permanode tagged
+// camliWritableRoot:<name>), each a cowDirV overlaying the same-named
+// read-only root under /versions, if one exists. This is where cowDirV
+// actually becomes reachable from a mount; there's no standalone
+// top-level "/workspace/<name>" root in this tree, since that would
+// require the mount-option/root-assembly code this snapshot doesn't
+// carry (it lives in cmd/cammount in the full camlistore tree).
+type workspaceDir struct {
+	noXattr
+	v *versionsDir // the owning /versions dir; guards all the fields below
+}
+
+func (d *workspaceDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | 0700,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+func (d *workspaceDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	d.v.mu.Lock()
+	defer d.v.mu.Unlock()
+	if err := d.v.condRefresh(); err != nil {
+		return nil, fuse.EIO
+	}
+	var ents []fuse.Dirent
+	for name := range d.v.writable {
+		ents = append(ents, fuse.Dirent{Name: name})
+	}
+	return ents, nil
+}
+
+func (d *workspaceDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	d.v.mu.Lock()
+	defer d.v.mu.Unlock()
+	if err := d.v.condRefresh(); err != nil {
+		return nil, err
+	}
+	pn, ok := d.v.writable[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if cd, ok := d.v.workspaceKids[name]; ok {
+		return cd, nil
+	}
+
+	var lower *roDirV
+	if rootPn, ok := d.v.m[name]; ok {
+		lower = newRODirV(d.v.fs, rootPn, name, d.v.cache())
+	}
+	cd := newCowDirV(d.v.fs, pn, lower)
+	if d.v.workspaceKids == nil {
+		d.v.workspaceKids = make(map[string]*cowDirV)
+	}
+	d.v.workspaceKids[name] = cd
+	return cd, nil
+}
@@ -25,11 +25,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/fs/contenthash"
 	"camlistore.org/pkg/search"
 	"camlistore.org/pkg/schema"
 
@@ -48,19 +50,66 @@ type roDirV struct {
 	parent    *roDirV // or nil, if the root within its roots.go root.
 	name      string // ent name (base name within parent)
 
+	// at, if non-zero, pins this dir (and everything populated
+	// below it) to how the tree looked at that instant, per
+	// search.DescribeRequest.At. Zero means "live".
+	at time.Time
+
+	// cache is the per-mount content-hash cache, shared by every
+	// roDirV and roFileLikeDir under the same mount.
+	cache *contenthash.Cache
+
 	mu       sync.Mutex
 	children map[string]roFileOrDir
 	xattrs   map[string][]byte
 }
 
-func newRODirV(fs *CamliFileSystem, permanode blob.Ref, name string) *roDirV {
+func newRODirV(fs *CamliFileSystem, permanode blob.Ref, name string, cache *contenthash.Cache) *roDirV {
+	return &roDirV{
+		fs:        fs,
+		permanode: permanode,
+		name:      name,
+		cache:     cache,
+	}
+}
+
+// newRODirVAt is like newRODirV but pins the returned dir (and its
+// descendants) to the given instant.
+func newRODirVAt(fs *CamliFileSystem, permanode blob.Ref, name string, at time.Time, cache *contenthash.Cache) *roDirV {
 	return &roDirV{
 		fs:        fs,
 		permanode: permanode,
 		name:      name,
+		at:        at,
+		cache:     cache,
 	}
 }
 
+// atDir is a peer of roDirV: it is the node Lookup returns for the
+// literal "@<instant>" path segment under a roDirV. It carries no
+// state of its own; it's just a roDirV pinned to the parsed instant,
+// given its own type so the "time travel" entry point is distinguishable
+// from an ordinary versioned directory.
+type atDir struct {
+	*roDirV
+}
+
+// parseInstant parses the "@<instant>" path-segment suffix s (the part
+// after the '@'). It accepts RFC3339, RFC3339Nano, and unix-second
+// timestamps.
+func parseInstant(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, errors.New("fs: invalid @ instant " + strconv.Quote(s))
+}
+
 // for debugging
 func (n *roDirV) fullPath() string {
 	if n == nil {
@@ -94,14 +143,29 @@ func (n *roDirV) populate() error {
 	res, err := n.fs.client.Describe(&search.DescribeRequest{
 		BlobRef: n.permanode,
 		Depth:   3,
+		At:      n.at,
 	})
 	if err != nil {
 		log.Println("roDirV.paths:", err)
 		return nil
 	}
+	if n.populateFromLocked(res) {
+		return nil
+	}
+	return errors.New("dir blobref not described")
+}
+
+// populateFromLocked builds n.children out of res, an already-fetched
+// Describe response, instead of issuing a Describe of its own. It
+// reports whether res actually reached n.permanode; false is expected
+// (not an error) when called to eagerly populate a child dir one or
+// more hops past where the caller's Depth budget ran out, and just
+// means n is left unpopulated for its own populate() to fetch lazily
+// later. Requires n.mu held.
+func (n *roDirV) populateFromLocked(res *search.DescribeResponse) bool {
 	db := res.Meta[n.permanode.String()]
 	if db == nil {
-		return errors.New("dir blobref not described")
+		return false
 	}
 
 	// Find all child permanodes and stick them in n.children
@@ -127,15 +191,33 @@ func (n *roDirV) populate() error {
 				name:      name,
 				symLink:   true,
 				target:    target,
+				cache:     n.cache,
 			}
 		} else if isDir(child.Permanode) {
-			// This is a directory.
-			n.children[name] = &roDirV{
+			// This is a directory. Children inherit n.at and n.cache
+			// so that a recursive walk under an @<instant> dir stays
+			// pinned to the same instant, and everyone under a mount
+			// shares one content-hash cache.
+			childDir := &roDirV{
 				fs:        n.fs,
 				permanode: blob.ParseOrZero(childRef),
 				parent:    n,
 				name:      name,
+				at:        n.at,
+				cache:     n.cache,
 			}
+			n.children[name] = childDir
+			// res already reached two hops past n's own permanode
+			// (Depth:3 above), which covers childDir's own camliPath:
+			// targets. Populate it from that data now instead of
+			// leaving it to issue its own redundant Describe the
+			// moment it's looked up or read; if res didn't reach far
+			// enough (its Depth budget ran out one level sooner),
+			// childDir just stays unpopulated and fetches lazily like
+			// before.
+			childDir.mu.Lock()
+			childDir.populateFromLocked(res)
+			childDir.mu.Unlock()
 		} else if contentRef := child.Permanode.Attr.Get("camliContent"); contentRef != "" {
 			// This is a file.
 			content := res.Meta[contentRef]
@@ -147,11 +229,28 @@ func (n *roDirV) populate() error {
 				log.Printf("child not a file: %v", childRef)
 				continue
 			}
+			if n.cache != nil {
+				n.cache.Put(filepath.Join(n.fullPath(), name), contenthash.HashBlobRef(contentRef))
+			}
+			if !n.at.IsZero() {
+				// Pinned to an instant: expose the single version
+				// that was current then, not the file->dates view.
+				n.children[name] = &roFileVersion{
+					fs:        n.fs,
+					permanode: blob.ParseOrZero(childRef),
+					parent:    &roFileLikeDir{fs: n.fs, permanode: blob.ParseOrZero(childRef), parent: n, name: name},
+					name:      name,
+					content:   content.BlobRef,
+					size:      content.File.Size,
+				}
+				continue
+			}
 			n.children[name] = &roFileLikeDir{
 				fs:        n.fs,
 				permanode: blob.ParseOrZero(childRef),
 				parent:    n,
 				name:      name,
+				cache:     n.cache,
 			}
 		} else {
 			// unknown type
@@ -159,7 +258,31 @@ func (n *roDirV) populate() error {
 		}
 		n.children[name].xattr().load(child.Permanode)
 	}
-	return nil
+
+	if n.cache != nil {
+		var headers []contenthash.DirHeader
+		for name, c := range n.children {
+			var mode os.FileMode
+			var digest contenthash.Digest
+			switch v := c.(type) {
+			case *roDirV:
+				mode = os.ModeDir | 0500
+				if d, ok := n.cache.Get(v.fullPath() + "/"); ok {
+					digest = d
+				}
+			default:
+				mode = 0400
+				if d, ok := n.cache.Get(filepath.Join(n.fullPath(), name)); ok {
+					digest = d
+				}
+			}
+			headers = append(headers, contenthash.DirHeader{Name: name, Mode: uint32(mode), ChildDigest: digest})
+		}
+		dirDigest := contenthash.HashDir(headers)
+		n.cache.Put(n.fullPath()+"/", dirDigest)
+		n.cache.Put(n.fullPath(), dirDigest)
+	}
+	return true
 }
 
 func (n *roDirV) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
@@ -176,7 +299,7 @@ func (n *roDirV) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 		case *roDirV:
 			ino = v.permanode.Sum64()
 		case *roFileVersion:
-			ino = v.permanode.Sum64()
+			ino = v.content.Sum64()
 		default:
 			log.Printf("roDirV.ReadDir: unknown child type %T", childNode)
 		}
@@ -197,6 +320,20 @@ func (n *roDirV) Lookup(name string, intr fs.Intr) (ret fs.Node, err fuse.Error)
 	defer func() {
 		log.Printf("roDirV(%q).Lookup(%q) = %#v, %v", n.fullPath(), name, ret, err)
 	}()
+	if strings.HasPrefix(name, "@") {
+		at, perr := parseInstant(name[1:])
+		if perr != nil {
+			return nil, fuse.ENOENT
+		}
+		return &atDir{&roDirV{
+			fs:        n.fs,
+			permanode: n.permanode,
+			parent:    n,
+			name:      name,
+			at:        at,
+			cache:     n.cache,
+		}}, nil
+	}
 	if err := n.populate(); err != nil {
 		log.Println("populate:", err)
 		return nil, fuse.EIO
@@ -221,17 +358,21 @@ type roFileLikeDir struct {
 
 	symLink      bool       // if true, is a symlink
 	target       string     // if a symlink
-	
-	mu       sync.Mutex
-	children map[string]roFileOrDir
-	xattrs   map[string][]byte
+	cache        *contenthash.Cache
+
+	mu        sync.Mutex
+	children  map[string]roFileOrDir
+	xattrs    map[string][]byte
+	latestName string                    // name of the newest dated entry, for ".latest"
+	byContent map[string]*roFileVersion // short blobref -> canonical entry, for ".by-content"
 }
 
-func newROFileLikeDir(fs *CamliFileSystem, permanode blob.Ref, name string) *roFileLikeDir {
+func newROFileLikeDir(fs *CamliFileSystem, permanode blob.Ref, name string, cache *contenthash.Cache) *roFileLikeDir {
 	return &roFileLikeDir{
 		fs:        fs,
 		permanode: permanode,
 		name:      name,
+		cache:     cache,
 	}
 }
 
@@ -277,6 +418,28 @@ func (n *roFileLikeDir) populate() error {
 		if !ok {
 			return errors.New("invalid blobref")
 		}
+		name := cl.Date.String()
+		versionPath := n.fullPath() + "@" + name
+
+		// cl.Value is a content blobref, and content is immutable once
+		// written: if some earlier populate (of this file or another
+		// one entirely) already resolved its size, reuse it instead of
+		// re-Describing the same blob.
+		if n.cache != nil {
+			if size, ok := n.cache.GetSize(cl.Value); ok {
+				n.cache.Put(versionPath, contenthash.HashBlobRef(cl.Value))
+				n.children[name] = &roFileVersion{
+					fs:        n.fs,
+					permanode: n.permanode,
+					parent:    n,
+					name:      name,
+					content:   pn,
+					size:      size,
+				}
+				continue
+			}
+		}
+
 		res, err := n.fs.client.Describe(&search.DescribeRequest{
 			BlobRef: pn, // this is camliContent
 			Depth:   1,
@@ -290,7 +453,10 @@ func (n *roFileLikeDir) populate() error {
 		if db == nil {
 			return errors.New("dir blobref not described")
 		}
-		name := cl.Date.String()
+		if n.cache != nil {
+			n.cache.Put(versionPath, contenthash.HashBlobRef(cl.Value))
+			n.cache.PutSize(cl.Value, db.File.Size)
+		}
 		n.children[name] = &roFileVersion{
 			fs:        n.fs,
 			permanode: n.permanode,
@@ -299,11 +465,49 @@ func (n *roFileLikeDir) populate() error {
 			content:   db.BlobRef,
 			size:      db.File.Size,
 		}
-			
+	}
+
+	// Hardlink-style dedup: several dated versions can share the same
+	// camliContent blob (e.g. a claim that re-set it to an unchanged
+	// value). Count them for Nlink, pick one canonical entry per
+	// distinct content for ".by-content", and remember the newest
+	// dated entry for ".latest".
+	counts := make(map[blob.Ref]int)
+	for _, c := range n.children {
+		if rv, ok := c.(*roFileVersion); ok {
+			counts[rv.content]++
+		}
+	}
+	n.byContent = make(map[string]*roFileVersion)
+	var latestDate time.Time
+	for _, cl := range res.Claims {
+		name := cl.Date.String()
+		rv, ok := n.children[name].(*roFileVersion)
+		if !ok {
+			continue
+		}
+		rv.nlink = uint32(counts[rv.content])
+		if short := shortBlobRef(rv.content); n.byContent[short] == nil {
+			n.byContent[short] = rv
+		}
+		if n.latestName == "" || cl.Date.After(latestDate) {
+			latestDate = cl.Date
+			n.latestName = name
+		}
 	}
 	return nil
 }
 
+// shortBlobRef returns a short, human-typeable prefix of br's string
+// form, for use as a ".by-content" entry name.
+func shortBlobRef(br blob.Ref) string {
+	s := br.String()
+	if i := strings.IndexByte(s, '-'); i >= 0 && len(s) > i+11 {
+		return s[:i+11]
+	}
+	return s
+}
+
 func (n *roFileLikeDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 	if err := n.populate(); err != nil {
 		log.Println("populate:", err)
@@ -318,7 +522,7 @@ func (n *roFileLikeDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 		case *roDirV:
 			ino = v.permanode.Sum64()
 		case *roFileVersion:
-			ino = v.permanode.Sum64()
+			ino = v.content.Sum64()
 		default:
 			log.Printf("roDirV.ReadDir: unknown child type %T", childNode)
 		}
@@ -332,6 +536,10 @@ func (n *roFileLikeDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 		log.Printf("roDirV(%q) appending inode %x, %+v", n.fullPath(), dirent.Inode, dirent)
 		ents = append(ents, dirent)
 	}
+	if n.latestName != "" {
+		ents = append(ents, fuse.Dirent{Name: ".latest"})
+	}
+	ents = append(ents, fuse.Dirent{Name: ".by-content"})
 	return ents, nil
 }
 
@@ -345,12 +553,78 @@ func (n *roFileLikeDir) Lookup(name string, intr fs.Intr) (ret fs.Node, err fuse
 	}
 	n.mu.Lock()
 	defer n.mu.Unlock()
+	switch name {
+	case ".latest":
+		if n.latestName == "" {
+			return nil, fuse.ENOENT
+		}
+		// A one-off symlink node, same shape as the symlink children
+		// roDirV.populate builds for real camliSymlinkTarget permanodes;
+		// not cached in n.children since it's just a view onto n.latestName.
+		return &roFileLikeDir{
+			fs:        n.fs,
+			permanode: n.permanode,
+			parent:    n.parent,
+			name:      ".latest",
+			symLink:   true,
+			target:    n.latestName,
+		}, nil
+	case ".by-content":
+		return &byContentDir{parent: n}, nil
+	}
 	if n2 := n.children[name]; n2 != nil {
 		return n2, nil
 	}
 	return nil, fuse.ENOENT
 }
 
+// byContentDir is the ".by-content" view under a roFileLikeDir: one
+// entry per distinct camliContent blob among its dated versions, named
+// by a short blobref prefix, so the dedup performed for Nlink is also
+// browsable directly by content.
+type byContentDir struct {
+	parent *roFileLikeDir
+}
+
+func (n *byContentDir) fullPath() string {
+	return filepath.Join(n.parent.fullPath(), ".by-content")
+}
+
+func (n *byContentDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | 0500,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+func (n *byContentDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	if err := n.parent.populate(); err != nil {
+		log.Println("populate:", err)
+		return nil, fuse.EIO
+	}
+	n.parent.mu.Lock()
+	defer n.parent.mu.Unlock()
+	var ents []fuse.Dirent
+	for short, rv := range n.parent.byContent {
+		ents = append(ents, fuse.Dirent{Name: short, Inode: rv.content.Sum64()})
+	}
+	return ents, nil
+}
+
+func (n *byContentDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	if err := n.parent.populate(); err != nil {
+		log.Println("populate:", err)
+		return nil, fuse.EIO
+	}
+	n.parent.mu.Lock()
+	defer n.parent.mu.Unlock()
+	if rv, ok := n.parent.byContent[name]; ok {
+		return rv, nil
+	}
+	return nil, fuse.ENOENT
+}
+
 // roFileVersion is the version of a file
 type roFileVersion struct {
 	fs        *CamliFileSystem
@@ -365,6 +639,12 @@ type roFileVersion struct {
 	size         int64
 	mtime, atime time.Time // if zero, use serverStart
 	xattrs       map[string][]byte
+
+	// nlink is the number of dated entries in the same roFileLikeDir
+	// that share this version's camliContent blob, e.g. because a
+	// claim re-set camliContent to an unchanged value. Exposed as
+	// fuse.Attr.Nlink, hardlink-style.
+	nlink uint32
 }
 
 // Empirically:
@@ -445,7 +725,15 @@ func (n *roFileVersion) Attr() fuse.Attr {
 	if size > 0 {
 		blocks = uint64(size)/512 + 1
 	}
-	inode := n.permanode.Sum64()
+	// Inode (and thus hardlink identity to the kernel) is keyed off the
+	// content blob, not this version's permanode: two dated versions
+	// with the same camliContent are the same file, same as two names
+	// linked to the same inode on a real filesystem.
+	inode := n.content.Sum64()
+	nlink := n.nlink
+	if nlink == 0 {
+		nlink = 1
+	}
 	if n.symLink {
 		mode |= os.ModeSymlink
 	}
@@ -454,6 +742,7 @@ func (n *roFileVersion) Attr() fuse.Attr {
 	return fuse.Attr{
 		Inode:  inode,
 		Mode:   mode,
+		Nlink:  nlink,
 		Uid:    uint32(os.Getuid()),
 		Gid:    uint32(os.Getgid()),
 		Size:   uint64(size),
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/fs/contenthash"
 	"camlistore.org/pkg/search"
 	"camlistore.org/pkg/syncutil"
 	"camlistore.org/third_party/bazil.org/fuse"
@@ -44,6 +45,21 @@ type versionsDir struct {
 	modTime     map[string]time.Time             // filename to permanode modtime
 	m           map[string]blob.Ref // ent name => permanode
 	children    map[string]fs.Node  // ent name => child node
+	hashCache   *contenthash.Cache  // shared by every roDirV under this mount
+
+	// writable maps a --writable-versions workspace name to its own
+	// (camliWritableRoot-tagged) permanode; workspaceKids caches the
+	// cowDirV built for it, one per name, under "workspace/<name>".
+	writable      map[string]blob.Ref
+	workspaceKids map[string]*cowDirV
+}
+
+// requires n.mu is held
+func (n *versionsDir) cache() *contenthash.Cache {
+	if n.hashCache == nil {
+		n.hashCache = contenthash.NewCache()
+	}
+	return n.hashCache
 }
 
 func (n *versionsDir) isRO() bool {
@@ -86,18 +102,40 @@ func (n *versionsDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
 	if err := n.condRefresh(); err != nil {
 		return nil, err
 	}
-	br := n.m[name]
+
+	if name == "workspace" {
+		return &workspaceDir{v: n}, nil
+	}
+
+	rootName := name
+	var at time.Time
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		rootName = name[:i]
+		t, err := parseInstant(name[i+1:])
+		if err != nil {
+			return nil, fuse.ENOENT
+		}
+		at = t
+	}
+
+	br := n.m[rootName]
 	if !br.Valid() {
 		return nil, fuse.ENOENT
 	}
 
+	if !at.IsZero() {
+		// "<root>@<instant>" shorthand for "<root>/@<instant>"; not
+		// cached since it's a one-off view pinned to a specific time.
+		return &atDir{newRODirVAt(n.fs, br, rootName, at, n.cache())}, nil
+	}
+
 	nod, ok := n.children[name]
-	
+
 	if ok {
 		return nod, nil
 	}
 
-	nod = newRODirV(n.fs, br, name)
+	nod = newRODirV(n.fs, br, name, n.cache())
 
 	n.children[name] = nod
 
@@ -111,7 +149,7 @@ func (n *versionsDir) condRefresh() fuse.Error {
 	}
 	log.Printf("fs.versions: querying")
 
-	var rootRes, impRes *search.WithAttrResponse
+	var rootRes, impRes, wrRes *search.WithAttrResponse
 	var grp syncutil.Group
 	grp.Go(func() (err error) {
 		rootRes, err = n.fs.client.GetPermanodesWithAttr(&search.WithAttrRequest{N: 100, Attr: "camliRoot"})
@@ -121,6 +159,10 @@ func (n *versionsDir) condRefresh() fuse.Error {
 		impRes, err = n.fs.client.GetPermanodesWithAttr(&search.WithAttrRequest{N: 100, Attr: "camliImportRoot"})
 		return
 	})
+	grp.Go(func() (err error) {
+		wrRes, err = n.fs.client.GetPermanodesWithAttr(&search.WithAttrRequest{N: 100, Attr: "camliWritableRoot"})
+		return
+	})
 	if err := grp.Err(); err != nil {
 		log.Printf("fs.versions: GetRecentPermanodes error in ReadDir: %v", err)
 		return fuse.EIO
@@ -140,6 +182,9 @@ func (n *versionsDir) condRefresh() fuse.Error {
 	for _, wi := range impRes.WithAttr {
 		dr.BlobRefs = append(dr.BlobRefs, wi.Permanode)
 	}
+	for _, wi := range wrRes.WithAttr {
+		dr.BlobRefs = append(dr.BlobRefs, wi.Permanode)
+	}
 	if len(dr.BlobRefs) == 0 {
 		return nil
 	}
@@ -165,10 +210,38 @@ func (n *versionsDir) condRefresh() fuse.Error {
 	}
 
 	// Remove any children objects we have mapped that are no
-	// longer relevant.
+	// longer relevant, along with anything the content-hash cache
+	// knows about that subtree: it no longer corresponds to a root,
+	// so its cached digests must not leak into whatever root (or
+	// workspace, see cow.go) takes the name next.
 	for name := range n.children {
 		if !currentRoots[name] {
 			delete(n.children, name)
+			if n.hashCache != nil {
+				n.hashCache.Invalidate("/" + name)
+			}
+		}
+	}
+
+	// Writable roots (--writable-versions workspaces), exposed under
+	// "workspace/<name>" by workspaceDir in cow.go.
+	n.writable = make(map[string]blob.Ref)
+	for _, wi := range wrRes.WithAttr {
+		pn := wi.Permanode
+		db := dres.Meta[pn.String()]
+		if db != nil && db.Permanode != nil {
+			name := db.Permanode.Attr.Get("camliWritableRoot")
+			if name != "" {
+				n.writable[name] = pn
+			}
+		}
+	}
+	for name := range n.workspaceKids {
+		if _, ok := n.writable[name]; !ok {
+			delete(n.workspaceKids, name)
+			if n.hashCache != nil {
+				n.hashCache.Invalidate("/workspace/" + name)
+			}
 		}
 	}
 